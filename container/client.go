@@ -4,18 +4,16 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
 	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/samalba/dockerclient"
 
-	engineapi "github.com/docker/engine-api/client"
-	enginetypes "github.com/docker/engine-api/types"
-	ctypes "github.com/docker/engine-api/types/container"
-	"github.com/docker/go-connections/nat"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
 )
 
 const (
@@ -37,33 +35,78 @@ type Client interface {
 	RenameContainer(Container, string) error
 	RemoveImage(Container, bool, bool) error
 	RemoveContainer(Container, bool, bool, bool, bool) error
+	// NetemContainer applies a netem command to a single container, optionally
+	// through the legacy single-IP filter (see startNetemContainerIPFilter for
+	// what that filter actually matches). Deprecated: use
+	// NetemContainerFilter, which supports CIDRs, ports, protocols and IPv6.
 	NetemContainer(Container, string, []string, net.IP, time.Duration, string, bool) error
 	StopNetemContainer(Container, string, string, bool) error
+	NetemContainerFilter(Container, string, []string, TrafficFilter, time.Duration, string, bool) error
+	ShapeContainer(Container, string, ShapeSpec, net.IP, time.Duration, string, bool) error
+	StopShapeContainer(Container, string, string, bool) error
 	PauseContainer(Container, bool) error
 	UnpauseContainer(Container, bool) error
+	RunSidecar(Container, SidecarSpec) (string, error)
+	StressContainer(Container, []string, string, time.Duration, bool) error
+	IOStressContainer(Container, []string, string, time.Duration, bool) error
+	FreezeFilesystem(Container, string, time.Duration, string, bool) error
+	// Cleanup tears down every still-active netem/shape/partition/sidecar
+	// activation, in
+	// parallel, bounded by ctx's deadline. Wire it to run before exit (e.g.
+	// via Trap) so a killed Pumba never leaves a container's traffic control
+	// rules installed.
+	Cleanup(ctx context.Context) error
+	// Watch subscribes to the Docker event stream and applies policy to
+	// every container matching fn as soon as it starts. It blocks until ctx
+	// is cancelled (the way to stop watching), reconnecting on stream
+	// errors with backoff.
+	Watch(ctx context.Context, fn Filter, policy ChaosPolicy) error
+	PartitionContainer(Container, PartitionSpec, time.Duration, string, bool) error
+	StopPartitionContainer(Container, PartitionSpec, string, bool) error
 }
 
 // NewClient returns a new Client instance which can be used to interact with
-// the Docker API.
+// the Docker API. It is a thin wrapper around the docker/docker client
+// constructor for callers that already have an explicit host/tlsConfig pair
+// (e.g. from CLI flags) instead of the standard DOCKER_* environment
+// variables that NewEnvClient reads.
 func NewClient(dockerHost string, tlsConfig *tls.Config) Client {
-	docker, err := dockerclient.NewDockerClient(dockerHost, tlsConfig)
+	httpClient := &http.Client{}
+	if tlsConfig != nil {
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	// version "" lets the client negotiate the highest API version the
+	// daemon supports, same as NewEnvClient() does for DOCKER_API_VERSION.
+	docker, err := client.NewClient(dockerHost, "", httpClient, nil)
 	if err != nil {
 		log.Fatalf("Error instantiating Docker client: %s", err)
 	}
 
-	// Use HTTP Client used by dockerclient to create engine-api client
-	apiClient, err := engineapi.NewClient(dockerHost, "", docker.HTTPClient, nil)
+	return dockerClient{apiClient: docker, registry: NewChaosRegistry()}
+}
+
+// NewEnvClient returns a new Client instance configured entirely from the
+// environment: DOCKER_HOST, DOCKER_TLS_VERIFY, DOCKER_CERT_PATH and
+// DOCKER_API_VERSION, as understood by the official docker/docker/client
+// package. This is the preferred constructor; NewClient remains for callers
+// that build their own TLS config.
+func NewEnvClient() (Client, error) {
+	docker, err := client.NewEnvClient()
 	if err != nil {
-		log.Fatalf("Error instantiating Docker engine-api: %s", err)
+		return nil, fmt.Errorf("error instantiating Docker client: %s", err)
 	}
 
-	return dockerClient{api: docker, apiClient: apiClient}
+	return dockerClient{apiClient: docker, registry: NewChaosRegistry()}, nil
 }
 
 type dockerClient struct {
-	api dockerclient.Client
-	// NOTE: use official docker/engine-api instead of samalba/dockerclient; lazy refactoring
-	apiClient engineapi.ContainerAPIClient
+	// apiClient is the unified docker/docker client, which satisfies
+	// ContainerAPIClient, ImageAPIClient and SystemAPIClient.
+	apiClient client.CommonAPIClient
+	// registry tracks active netem/shape/partition/sidecar activations so
+	// Cleanup can tear them down on exit.
+	registry *ChaosRegistry
 }
 
 func (client dockerClient) ListContainers(fn Filter) ([]Container, error) {
@@ -71,18 +114,19 @@ func (client dockerClient) ListContainers(fn Filter) ([]Container, error) {
 
 	log.Debug("Retrieving running containers")
 
-	runningContainers, err := client.api.ListContainers(false, false, "")
+	ctx := context.Background()
+	runningContainers, err := client.apiClient.ContainerList(ctx, types.ContainerListOptions{})
 	if err != nil {
 		return nil, err
 	}
 	for _, runningContainer := range runningContainers {
-		containerInfo, err := client.api.InspectContainer(runningContainer.Id)
+		containerInfo, err := client.apiClient.ContainerInspect(ctx, runningContainer.ID)
 		if err != nil {
 			return nil, err
 		}
-		log.Debugf("Running container: %s - (%s)", containerInfo.Name, containerInfo.Id)
+		log.Debugf("Running container: %s - (%s)", containerInfo.Name, containerInfo.ID)
 
-		imageInfo, err := client.api.InspectImage(containerInfo.Image)
+		imageInfo, _, err := client.apiClient.ImageInspectWithRaw(ctx, containerInfo.Image)
 		if err != nil {
 			return nil, err
 		}
@@ -103,7 +147,7 @@ func (client dockerClient) KillContainer(c Container, signal string, dryrun bool
 	}
 	log.Infof("%sKilling %s (%s) with signal %s", prefix, c.Name(), c.ID(), signal)
 	if !dryrun {
-		if err := client.api.KillContainer(c.ID(), signal); err != nil {
+		if err := client.apiClient.ContainerKill(context.Background(), c.ID(), signal); err != nil {
 			return err
 		}
 	}
@@ -121,7 +165,8 @@ func (client dockerClient) StopContainer(c Container, timeout int, dryrun bool)
 	}
 	log.Infof("%sStopping %s (%s) with %s", prefix, c.Name(), c.ID(), signal)
 	if !dryrun {
-		if err := client.api.KillContainer(c.ID(), signal); err != nil {
+		ctx := context.Background()
+		if err := client.apiClient.ContainerKill(ctx, c.ID(), signal); err != nil {
 			return err
 		}
 
@@ -131,7 +176,7 @@ func (client dockerClient) StopContainer(c Container, timeout int, dryrun bool)
 		}
 
 		log.Debugf("Killing container %s with %s", c.ID(), defaultKillSignal)
-		if err := client.api.KillContainer(c.ID(), defaultKillSignal); err != nil {
+		if err := client.apiClient.ContainerKill(ctx, c.ID(), defaultKillSignal); err != nil {
 			return err
 		}
 
@@ -151,19 +196,20 @@ func (client dockerClient) StartContainer(c Container) error {
 
 	log.Infof("Starting %s", name)
 
-	newContainerID, err := client.api.CreateContainer(config, name, nil)
+	ctx := context.Background()
+	created, err := client.apiClient.ContainerCreate(ctx, config, hostConfig, nil, name)
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("Starting container %s (%s)", name, newContainerID)
+	log.Debugf("Starting container %s (%s)", name, created.ID)
 
-	return client.api.StartContainer(newContainerID, hostConfig)
+	return client.apiClient.ContainerStart(ctx, created.ID, types.ContainerStartOptions{})
 }
 
 func (client dockerClient) RenameContainer(c Container, newName string) error {
 	log.Debugf("Renaming container %s (%s) to %s", c.Name(), c.ID(), newName)
-	return client.api.RenameContainer(c.ID(), newName)
+	return client.apiClient.ContainerRename(context.Background(), c.ID(), newName)
 }
 
 func (client dockerClient) RemoveImage(c Container, force bool, dryrun bool) error {
@@ -174,7 +220,7 @@ func (client dockerClient) RemoveImage(c Container, force bool, dryrun bool) err
 	}
 	log.Infof("%sRemoving image %s", prefix, imageID)
 	if !dryrun {
-		_, err := client.api.RemoveImage(imageID, force)
+		_, err := client.apiClient.ImageRemove(context.Background(), imageID, types.ImageRemoveOptions{Force: force})
 		return err
 	}
 	return nil
@@ -187,7 +233,7 @@ func (client dockerClient) RemoveContainer(c Container, force bool, links bool,
 	}
 	log.Infof("%sRemoving container %s", prefix, c.ID())
 	if !dryrun {
-		removeOpts := enginetypes.ContainerRemoveOptions{
+		removeOpts := types.ContainerRemoveOptions{
 			RemoveVolumes: links,
 			RemoveLinks:   volumes,
 			Force:         force,
@@ -212,8 +258,14 @@ func (client dockerClient) NetemContainer(c Container, netInterface string, nete
 	}
 	if err != nil {
 		log.Error(err)
+		return err
 	}
-	return err
+	if !dryrun && client.registry != nil {
+		client.registry.Register(netemActivationID(c, netInterface), NetemActivation, func() error {
+			return client.StopNetemContainer(c, netInterface, tcimage, false)
+		})
+	}
+	return nil
 }
 
 func (client dockerClient) StopNetemContainer(c Container, netInterface string, tcimage string, dryrun bool) error {
@@ -226,9 +278,21 @@ func (client dockerClient) StopNetemContainer(c Container, netInterface string,
 	if err != nil {
 		log.Error(err)
 	}
+	if !dryrun && client.registry != nil {
+		client.registry.Unregister(netemActivationID(c, netInterface))
+	}
 	return err
 }
 
+// Cleanup tears down every still-active netem/shape/partition/sidecar
+// activation known to this client's registry.
+func (client dockerClient) Cleanup(ctx context.Context) error {
+	if client.registry == nil {
+		return nil
+	}
+	return client.registry.Cleanup(ctx)
+}
+
 func (client dockerClient) PauseContainer(c Container, dryrun bool) error {
 	prefix := ""
 	if dryrun {
@@ -266,7 +330,7 @@ func (client dockerClient) startNetemContainer(c Container, netInterface string,
 	}
 	log.Infof("%sStart netem for container %s on '%s' with command '%s'", prefix, c.ID(), netInterface, netemCmd)
 	if !dryrun {
-		// use dockerclient ExecStart to run Traffic Control:
+		// use ContainerExecCreate/Start to run Traffic Control:
 		// 'tc qdisc add dev eth0 root netem delay 100ms'
 		// http://www.linuxfoundation.org/collaborate/workgroups/networking/netem
 		netemCommand := append([]string{"qdisc", "add", "dev", netInterface, "root", "netem"}, netemCmd...)
@@ -294,6 +358,10 @@ func (client dockerClient) stopNetemContainer(c Container, netInterface string,
 	return nil
 }
 
+// startNetemContainerIPFilter is the legacy, single destination-IP netem
+// filter. Deprecated: its "match ip dport <targetIP>" filter matches a
+// destination port against an IP string, which never matches as intended.
+// New code should go through NetemContainerFilter / startNetemContainerFilter.
 func (client dockerClient) startNetemContainerIPFilter(c Container, netInterface string, netemCmd []string,
 	targetIP string, tcimage string, dryrun bool) error {
 	prefix := ""
@@ -303,7 +371,6 @@ func (client dockerClient) startNetemContainerIPFilter(c Container, netInterface
 	log.Infof("%sStart netem for container %s on '%s' with command '%s', filter by IP '%s'",
 		prefix, c.ID(), netInterface, netemCmd, targetIP)
 	if !dryrun {
-		// use dockerclient ExecStart to run Traffic Control
 		// to filter network, needs to create a priority scheduling, add a low priority
 		// queue, apply netem command on that queue only, then route IP traffic to the low priority queue
 		// See more: http://www.linuxfoundation.org/collaborate/workgroups/networking/netem
@@ -349,56 +416,37 @@ func (client dockerClient) tcCommand(c Container, args []string, tcimage string)
 // execute tc command using other container (with iproute2 package installed), using target container network stack
 // try to use `gaiadocker\iproute2` image (Alpine + iproute2 package)
 func (client dockerClient) tcContainerCommand(target Container, args []string, tcimage string) error {
-	log.Debugf("target tc image: %s", tcimage)
-	// container config
-	config := ctypes.Config{
-		Labels:     map[string]string{"com.gaiaadm.pumba.skip": "true"},
-		Entrypoint: []string{"tc"},
-		Cmd:        args,
-		Image:      tcimage,
-	}
-	log.Debugf("Container Config: %s", config)
-	// host config
-	hconfig := ctypes.HostConfig{
-		// auto remove container on tc command exit
-		AutoRemove: true,
-		// NET_ADMIN is required for "tc netem"
-		CapAdd: []string{"NET_ADMIN"},
-		// use target container network stack
-		NetworkMode: ctypes.NetworkMode("container:" + target.ID()),
-		// others
-		PortBindings: nat.PortMap{},
-		DNS:          []string{},
-		DNSOptions:   []string{},
-		DNSSearch:    []string{},
-	}
-	log.Debugf("Host Config: %s", hconfig)
-	createResponse, err := client.apiClient.ContainerCreate(context.Background(), &config, &hconfig, nil, "")
-	if err != nil {
-		return err
-	}
-	log.Debugf("tc container id: %s", createResponse.ID)
-	return client.apiClient.ContainerStart(context.Background(), createResponse.ID, enginetypes.ContainerStartOptions{})
+	_, err := client.RunSidecar(target, SidecarSpec{
+		Image:        tcimage,
+		Entrypoint:   []string{"tc"},
+		Cmd:          args,
+		CapAdd:       []string{"NET_ADMIN"},
+		ShareNetwork: true,
+		WaitForExit:  true,
+	})
+	return err
 }
 
 func (client dockerClient) execOnContainer(c Container, execCmd string, execArgs []string, privileged bool) error {
 	// trim all spaces from cmd
 	execCmd = strings.Replace(execCmd, " ", "", -1)
 
+	ctx := context.Background()
+
 	// check if command exists inside target container
-	checkExists := enginetypes.ExecConfig{
+	checkExists := types.ExecConfig{
 		Cmd: []string{"which", execCmd},
 	}
-	exec, err := client.apiClient.ContainerExecCreate(context.Background(), c.ID(), checkExists)
+	exec, err := client.apiClient.ContainerExecCreate(ctx, c.ID(), checkExists)
 	if err != nil {
 		return err
 	}
 	log.Debugf("checking if command %s exists", execCmd)
-	err = client.apiClient.ContainerExecStart(context.Background(), exec.ID, enginetypes.ExecStartCheck{})
+	err = client.apiClient.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{})
 	if err != nil {
 		return err
 	}
-	checkInspect, err := client.apiClient.ContainerExecInspect(context.Background(), exec.ID)
+	checkInspect, err := client.apiClient.ContainerExecInspect(ctx, exec.ID)
 	if err != nil {
 		return err
 	}
@@ -408,21 +456,21 @@ func (client dockerClient) execOnContainer(c Container, execCmd string, execArgs
 	log.Debugf("command %s found: continue...", execCmd)
 
 	// prepare exec config
-	config := enginetypes.ExecConfig{
+	config := types.ExecConfig{
 		Privileged: privileged,
 		Cmd:        append([]string{execCmd}, execArgs...),
 	}
 	// execute the command
-	exec, err = client.apiClient.ContainerExecCreate(context.Background(), c.ID(), config)
+	exec, err = client.apiClient.ContainerExecCreate(ctx, c.ID(), config)
 	if err != nil {
 		return err
 	}
 	log.Debugf("Starting Exec %s %s (%s)", execCmd, execArgs, exec.ID)
-	err = client.apiClient.ContainerExecStart(context.Background(), exec.ID, enginetypes.ExecStartCheck{})
+	err = client.apiClient.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{})
 	if err != nil {
 		return err
 	}
-	exitInspect, err := client.apiClient.ContainerExecInspect(context.Background(), exec.ID)
+	exitInspect, err := client.apiClient.ContainerExecInspect(ctx, exec.ID)
 	if err != nil {
 		return err
 	}
@@ -440,7 +488,7 @@ func (client dockerClient) waitForStop(c Container, waitTime int) error {
 		case <-timeout:
 			return nil
 		default:
-			if ci, err := client.api.InspectContainer(c.ID()); err != nil {
+			if ci, err := client.apiClient.ContainerInspect(context.Background(), c.ID()); err != nil {
 				return err
 			} else if !ci.State.Running {
 				return nil
@@ -0,0 +1,250 @@
+package container
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ipv4L4Offset and ipv6L4Offset are the byte offsets, from the start of the
+// IP header, at which the transport header (and therefore sport/dport)
+// begins. They assume no IP options / extension headers, which matches
+// what iproute2's own "match ip sport/dport" convenience keyword assumes.
+const (
+	ipv4L4Offset = 20
+	ipv6L4Offset = 40
+)
+
+// protocolNumber maps the Protocol field of a TrafficFilter to its IP
+// protocol / IPv6 next-header number.
+var protocolNumber = map[string]byte{
+	"icmp": 1,
+	"tcp":  6,
+	"udp":  17,
+}
+
+// TrafficFilter describes which traffic a netem command should be applied
+// to. It replaces the single target-IP filter, which could only match a
+// destination IPv4 address and, for ports, built an invalid filter (it
+// matched a destination port against an IP address string). Every CIDR and
+// every port gets its own filter, all routed into netem's band (1:3), so
+// traffic matching any one of them is affected; a CIDR and a port are never
+// combined into the same filter. Protocol, if set, is added to every filter.
+type TrafficFilter struct {
+	SrcCIDRs []string
+	DstCIDRs []string
+	SrcPorts []int
+	DstPorts []int
+	Protocol string // "tcp", "udp" or "icmp"; empty matches any protocol
+	IPFamily string // "v4" or "v6"; defaults to "v4"
+}
+
+func (f TrafficFilter) tcProtocol() string {
+	if f.IPFamily == "v6" {
+		return "ipv6"
+	}
+	return "ip"
+}
+
+func (f TrafficFilter) l4Offset() int {
+	if f.IPFamily == "v6" {
+		return ipv6L4Offset
+	}
+	return ipv4L4Offset
+}
+
+func (client dockerClient) NetemContainerFilter(c Container, netInterface string, netemCmd []string, filter TrafficFilter, duration time.Duration, tcimage string, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	log.Infof("%sRunning netem command '%s' on container %s with filter %+v for %s", prefix, netemCmd, c.ID(), filter, duration)
+	err := client.startNetemContainerFilter(c, netInterface, netemCmd, filter, tcimage, dryrun)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if !dryrun && client.registry != nil {
+		client.registry.Register(netemActivationID(c, netInterface), NetemActivation, func() error {
+			return client.StopNetemContainer(c, netInterface, tcimage, false)
+		})
+	}
+	return nil
+}
+
+func (client dockerClient) startNetemContainerFilter(c Container, netInterface string, netemCmd []string, filter TrafficFilter, tcimage string, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	log.Infof("%sStart netem for container %s on '%s' with command '%s', filter %+v",
+		prefix, c.ID(), netInterface, netemCmd, filter)
+	if !dryrun {
+		// Create a priority-based queue, same as the legacy single-IP path.
+		// 'tc qdisc add dev <netInterface> root handle 1: prio'
+		handleCommand := []string{"qdisc", "add", "dev", netInterface, "root", "handle", "1:", "prio"}
+		log.Debugf("handleCommand %s", handleCommand)
+		if err := client.tcCommand(c, handleCommand, tcimage); err != nil {
+			return err
+		}
+
+		// Delay everything routed into band 3.
+		// 'tc qdisc add dev <netInterface> parent 1:3 netem <netemCmd>'
+		netemCommand := append([]string{"qdisc", "add", "dev", netInterface, "parent", "1:3", "netem"}, netemCmd...)
+		log.Debugf("netemCommand %s", netemCommand)
+		if err := client.tcCommand(c, netemCommand, tcimage); err != nil {
+			return err
+		}
+
+		filterCommands, err := filter.filterCommands(netInterface)
+		if err != nil {
+			return err
+		}
+		for _, filterCommand := range filterCommands {
+			log.Debugf("filterCommand %s", filterCommand)
+			if err := client.tcCommand(c, filterCommand, tcimage); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// filterCommands builds one "tc filter add ... flowid 1:3" argument list per
+// src/dst CIDR and one per src/dst port described by f. If f carries no CIDRs or
+// ports at all - e.g. a Protocol-only filter - a single filter matching just
+// the protocol is emitted, so the netem qdisc still receives traffic.
+func (f TrafficFilter) filterCommands(netInterface string) ([][]string, error) {
+	var matchSets [][]string
+
+	for _, cidr := range f.SrcCIDRs {
+		m, err := f.addressMatch("src", cidr)
+		if err != nil {
+			return nil, err
+		}
+		matchSets = append(matchSets, m)
+	}
+	for _, cidr := range f.DstCIDRs {
+		m, err := f.addressMatch("dst", cidr)
+		if err != nil {
+			return nil, err
+		}
+		matchSets = append(matchSets, m)
+	}
+	for _, port := range f.SrcPorts {
+		matchSets = append(matchSets, f.portMatch("sport", port))
+	}
+	for _, port := range f.DstPorts {
+		matchSets = append(matchSets, f.portMatch("dport", port))
+	}
+
+	protoMatch := f.protocolMatch()
+
+	if len(matchSets) == 0 {
+		if protoMatch == nil {
+			return nil, nil
+		}
+		// no CIDR/port criteria, just the protocol: one filter, no extra match
+		matchSets = append(matchSets, nil)
+	}
+
+	prio := 1
+	commands := make([][]string, 0, len(matchSets))
+	for _, match := range matchSets {
+		args := []string{"filter", "add", "dev", netInterface, "protocol", f.tcProtocol(),
+			"parent", "1:0", "prio", strconv.Itoa(prio), "u32"}
+		args = append(args, match...)
+		args = append(args, protoMatch...)
+		args = append(args, "flowid", "1:3")
+		commands = append(commands, args)
+		prio++
+	}
+	return commands, nil
+}
+
+// addressMatch returns the "match ..." tokens that pin a filter to a src/dst
+// CIDR. IPv4 uses iproute2's "match ip src/dst <cidr>" convenience keyword.
+// IPv6 does not have an equivalent for arbitrary (non-byte-aligned) prefix
+// lengths, so it is matched with up to four raw 32-bit "match u32 ... at
+// <offset>" expressions, one per 32-bit word the prefix covers (a /64 gives
+// two, a /128 four).
+func (f TrafficFilter) addressMatch(direction string, cidr string) ([]string, error) {
+	if f.IPFamily != "v6" {
+		return []string{"match", "ip", direction, cidr}, nil
+	}
+
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		ip = net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 address/CIDR %q", cidr)
+		}
+		ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+	ip16 := ip.To16()
+	if ip16 == nil || ip.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 address %q", cidr)
+	}
+	prefixLen, _ := ipNet.Mask.Size()
+
+	// src address starts right after the fixed 8-byte IPv6 header fields,
+	// dst address immediately follows it.
+	baseOffset := 8
+	if direction == "dst" {
+		baseOffset = 24
+	}
+
+	var matches []string
+	for word := 0; word < 4; word++ {
+		bitsLeft := prefixLen - word*32
+		if bitsLeft <= 0 {
+			break
+		}
+		wordBits := bitsLeft
+		if wordBits > 32 {
+			wordBits = 32
+		}
+		mask := uint32(0xffffffff) << uint(32-wordBits)
+		value := binary.BigEndian.Uint32(ip16[word*4:word*4+4]) & mask
+		matches = append(matches, "match", "u32",
+			fmt.Sprintf("0x%08x", value), fmt.Sprintf("0x%08x", mask),
+			"at", strconv.Itoa(baseOffset+word*4))
+	}
+	return matches, nil
+}
+
+// portMatch returns the "match ..." tokens that pin a filter to a src/dst
+// port. IPv4 uses the "match ip sport/dport <port> 0xffff" keyword, anchored
+// at offset 20 (start of the transport header, assuming no IP options).
+// IPv6 has no such keyword, so sport/dport (which share one 32-bit word at
+// offset 40) are matched directly with a raw u32 expression.
+func (f TrafficFilter) portMatch(which string, port int) []string {
+	if f.IPFamily != "v6" {
+		return []string{"match", "ip", which, strconv.Itoa(port), "0xffff"}
+	}
+
+	if which == "sport" {
+		return []string{"match", "u32", fmt.Sprintf("0x%04x0000", port), "0xffff0000", "at", strconv.Itoa(ipv6L4Offset)}
+	}
+	return []string{"match", "u32", fmt.Sprintf("0x%08x", port), "0x0000ffff", "at", strconv.Itoa(ipv6L4Offset)}
+}
+
+// protocolMatch returns the extra "match u8 ..." tokens that pin every
+// generated filter to f.Protocol, if set. The protocol / next-header field
+// is one byte, at offset 9 for IPv4 and offset 6 for IPv6.
+func (f TrafficFilter) protocolMatch() []string {
+	num, ok := protocolNumber[strings.ToLower(f.Protocol)]
+	if !ok {
+		return nil
+	}
+	offset := 9
+	if f.IPFamily == "v6" {
+		offset = 6
+	}
+	return []string{"match", "u8", fmt.Sprintf("0x%02x", num), "0xff", "at", strconv.Itoa(offset)}
+}
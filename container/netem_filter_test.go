@@ -0,0 +1,137 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddressMatchIPv4(t *testing.T) {
+	f := TrafficFilter{}
+	got, err := f.addressMatch("dst", "10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []string{"match", "ip", "dst", "10.0.0.0/8"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestAddressMatchIPv6(t *testing.T) {
+	f := TrafficFilter{IPFamily: "v6"}
+
+	cases := []struct {
+		name      string
+		direction string
+		cidr      string
+		wantWords int
+		wantFirst []string // first "match u32 <value> <mask> at <offset>" clause
+	}{
+		{
+			name:      "src /64 aligned prefix emits two full words",
+			direction: "src",
+			cidr:      "2001:db8::/64",
+			wantWords: 2,
+			wantFirst: []string{"match", "u32", "0x20010db8", "0xffffffff", "at", "8"},
+		},
+		{
+			name:      "dst /128 single host emits four words",
+			direction: "dst",
+			cidr:      "2001:db8::1/128",
+			wantWords: 4,
+			wantFirst: []string{"match", "u32", "0x20010db8", "0xffffffff", "at", "24"},
+		},
+		{
+			name:      "dst /48 emits one full word plus one partial word",
+			direction: "dst",
+			cidr:      "2001:db8::/48",
+			wantWords: 2,
+			wantFirst: []string{"match", "u32", "0x20010db8", "0xffffffff", "at", "24"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := f.addressMatch(tc.direction, tc.cidr)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			// each "match u32 <value> <mask> at <offset>" clause is 6 tokens
+			if len(got) != tc.wantWords*6 {
+				t.Fatalf("got %d tokens (%v), want %d words", len(got), got, tc.wantWords)
+			}
+			if !reflect.DeepEqual(got[:6], tc.wantFirst) {
+				t.Fatalf("first match clause = %v, want %v", got[:6], tc.wantFirst)
+			}
+		})
+	}
+}
+
+func TestAddressMatchIPv6Invalid(t *testing.T) {
+	f := TrafficFilter{IPFamily: "v6"}
+	if _, err := f.addressMatch("dst", "not-an-address"); err == nil {
+		t.Fatal("expected an error for an invalid IPv6 address")
+	}
+	if _, err := f.addressMatch("dst", "10.0.0.0/8"); err == nil {
+		t.Fatal("expected an error for an IPv4 CIDR in an IPv6 filter")
+	}
+}
+
+func TestPortMatchIPv4(t *testing.T) {
+	f := TrafficFilter{}
+	if got, want := f.portMatch("sport", 80), []string{"match", "ip", "sport", "80", "0xffff"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("sport: got %v, want %v", got, want)
+	}
+	if got, want := f.portMatch("dport", 443), []string{"match", "ip", "dport", "443", "0xffff"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("dport: got %v, want %v", got, want)
+	}
+}
+
+func TestPortMatchIPv6(t *testing.T) {
+	f := TrafficFilter{IPFamily: "v6"}
+	if got, want := f.portMatch("sport", 80), []string{"match", "u32", "0x00500000", "0xffff0000", "at", "40"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("sport: got %v, want %v", got, want)
+	}
+	if got, want := f.portMatch("dport", 443), []string{"match", "u32", "0x000001bb", "0x0000ffff", "at", "40"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("dport: got %v, want %v", got, want)
+	}
+}
+
+func TestProtocolMatch(t *testing.T) {
+	if got := (TrafficFilter{}).protocolMatch(); got != nil {
+		t.Fatalf("expected no match for an unset protocol, got %v", got)
+	}
+	if got := (TrafficFilter{Protocol: "bogus"}).protocolMatch(); got != nil {
+		t.Fatalf("expected no match for an unknown protocol, got %v", got)
+	}
+
+	if got, want := (TrafficFilter{Protocol: "tcp"}).protocolMatch(),
+		[]string{"match", "u8", "0x06", "0xff", "at", "9"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ipv4 tcp: got %v, want %v", got, want)
+	}
+	if got, want := (TrafficFilter{Protocol: "ICMP", IPFamily: "v6"}).protocolMatch(),
+		[]string{"match", "u8", "0x01", "0xff", "at", "6"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ipv6 icmp: got %v, want %v", got, want)
+	}
+}
+
+func TestFilterCommandsProtocolOnly(t *testing.T) {
+	f := TrafficFilter{Protocol: "udp"}
+	commands, err := f.filterCommands("eth0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(commands) != 1 {
+		t.Fatalf("expected exactly one filter for a protocol-only TrafficFilter, got %d: %v", len(commands), commands)
+	}
+}
+
+func TestFilterCommandsEmpty(t *testing.T) {
+	commands, err := (TrafficFilter{}).filterCommands("eth0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(commands) != 0 {
+		t.Fatalf("expected no filters for an empty TrafficFilter, got %d: %v", len(commands), commands)
+	}
+}
@@ -0,0 +1,197 @@
+package container
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// PartitionDirection selects which iptables built-in chain a PartitionSpec's
+// rules are inserted into.
+type PartitionDirection string
+
+const (
+	PartitionInput  PartitionDirection = "INPUT"
+	PartitionOutput PartitionDirection = "OUTPUT"
+	PartitionBoth   PartitionDirection = "BOTH"
+)
+
+// PartitionSpec describes a full network blackhole: unlike netem's
+// "loss 100%", it drops both directions (or either one alone), so the
+// container is really cut off from its peers rather than just unable to
+// send. Ports/Protocol narrow it to specific traffic; leaving both empty
+// drops all traffic to/from PeerCIDRs.
+type PartitionSpec struct {
+	Direction PartitionDirection
+	PeerCIDRs []string
+	Ports     []int
+	Protocol  string // tcp/udp/icmp; defaults to tcp when Ports is set and Protocol is empty
+}
+
+func (spec PartitionSpec) directions() []PartitionDirection {
+	if spec.Direction == PartitionBoth {
+		return []PartitionDirection{PartitionInput, PartitionOutput}
+	}
+	return []PartitionDirection{spec.Direction}
+}
+
+// validate rejects a PartitionSpec whose Direction isn't one of the three
+// recognized values - in particular the zero value "", which would
+// otherwise turn into `iptables -I "" ...` and only fail once
+// runIptablesRules' sidecar exits non-zero.
+func (spec PartitionSpec) validate() error {
+	switch spec.Direction {
+	case PartitionInput, PartitionOutput, PartitionBoth:
+		return nil
+	default:
+		return fmt.Errorf("invalid partition direction %q: must be one of %q, %q, %q",
+			spec.Direction, PartitionInput, PartitionOutput, PartitionBoth)
+	}
+}
+
+// iptablesRule is one "iptables"/"ip6tables" invocation, split into the
+// binary to run (chosen per-CIDR, since a partition can mix v4 and v6 peers)
+// and its arguments.
+type iptablesRule struct {
+	bin  string
+	args []string
+}
+
+// rules builds the iptablesRule set for spec, tagging every rule with
+// "-m comment --comment pumba:<tag>" so it can later be told apart from any
+// pre-existing user rule in the same chain. action is "-I" to install or
+// "-D" to remove; passing the same (spec, tag) with "-D" deletes exactly the
+// rules "-I" inserted.
+func (spec PartitionSpec) rules(tag string, action string) []iptablesRule {
+	proto := spec.Protocol
+	if proto == "" && len(spec.Ports) > 0 {
+		proto = "tcp"
+	}
+
+	var result []iptablesRule
+	for _, dir := range spec.directions() {
+		addrFlag := "-d"
+		if dir == PartitionInput {
+			addrFlag = "-s"
+		}
+		for _, cidr := range spec.PeerCIDRs {
+			bin := "iptables"
+			if isIPv6CIDR(cidr) {
+				bin = "ip6tables"
+			}
+			base := []string{action, string(dir), addrFlag, cidr}
+			if proto != "" {
+				base = append(base, "-p", proto)
+			}
+			if len(spec.Ports) == 0 {
+				result = append(result, iptablesRule{bin: bin, args: withComment(base, tag)})
+				continue
+			}
+			for _, port := range spec.Ports {
+				args := append(append([]string{}, base...), "--dport", strconv.Itoa(port))
+				result = append(result, iptablesRule{bin: bin, args: withComment(args, tag)})
+			}
+		}
+	}
+	return result
+}
+
+func withComment(args []string, tag string) []string {
+	return append(append([]string{}, args...), "-m", "comment", "--comment", "pumba:"+tag, "-j", "DROP")
+}
+
+func isIPv6CIDR(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		ip = net.ParseIP(cidr)
+	}
+	return ip != nil && ip.To4() == nil
+}
+
+// partitionTag deterministically identifies a (container, spec) pair, so
+// StopPartitionContainer can recompute the exact same tag - and therefore
+// the exact same rules - without the caller having to hold onto anything
+// PartitionContainer generated.
+func partitionTag(c Container, spec PartitionSpec) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%s|%v|%v|%s", c.ID(), spec.Direction, spec.PeerCIDRs, spec.Ports, spec.Protocol)
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+func (client dockerClient) PartitionContainer(c Container, spec PartitionSpec, duration time.Duration, image string, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	tag := partitionTag(c, spec)
+	log.Infof("%sPartitioning container %s (%s) for %s, rule tag pumba:%s", prefix, c.Name(), c.ID(), duration, tag)
+	if dryrun {
+		return nil
+	}
+
+	rules := spec.rules(tag, "-I")
+	if len(rules) == 0 {
+		return fmt.Errorf("partition spec for container %s produced no iptables rules", c.ID())
+	}
+	if err := client.runIptablesRules(c, rules, image); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if client.registry != nil {
+		client.registry.Register(partitionActivationID(c, tag), PartitionActivation, func() error {
+			return client.StopPartitionContainer(c, spec, image, false)
+		})
+	}
+	return nil
+}
+
+func (client dockerClient) StopPartitionContainer(c Container, spec PartitionSpec, image string, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	tag := partitionTag(c, spec)
+	log.Infof("%sRemoving network partition on container %s, rule tag pumba:%s", prefix, c.ID(), tag)
+
+	var err error
+	if !dryrun {
+		err = client.runIptablesRules(c, spec.rules(tag, "-D"), image)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	if client.registry != nil {
+		client.registry.Unregister(partitionActivationID(c, tag))
+	}
+	return err
+}
+
+// runIptablesRules runs each rule in its own sidecar, same pattern as
+// tcContainerCommand: CAP_NET_ADMIN, sharing the target's network
+// namespace, auto-removing on exit.
+func (client dockerClient) runIptablesRules(c Container, rules []iptablesRule, image string) error {
+	for _, rule := range rules {
+		if _, err := client.RunSidecar(c, SidecarSpec{
+			Image:        image,
+			Entrypoint:   []string{rule.bin},
+			Cmd:          rule.args,
+			CapAdd:       []string{"NET_ADMIN"},
+			ShareNetwork: true,
+			WaitForExit:  true,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package container
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ActivationKind labels what a ChaosRegistry entry tears down, for logging only.
+type ActivationKind string
+
+const (
+	// NetemActivation is a netem (or netem+filter) qdisc on a container's interface.
+	NetemActivation ActivationKind = "netem"
+	// ShapeActivation is a tbf/htb qdisc on a container's interface.
+	ShapeActivation ActivationKind = "shape"
+	// SidecarActivation is a long-running chaos sidecar (stress, fsfreeze, ...).
+	SidecarActivation ActivationKind = "sidecar"
+	// PartitionActivation is a set of tagged iptables/ip6tables DROP rules.
+	PartitionActivation ActivationKind = "partition"
+)
+
+// activation is one still-active chaos action: enough to log it, plus a
+// closure that reverses it.
+type activation struct {
+	kind ActivationKind
+	stop func() error
+}
+
+// ChaosRegistry tracks every active netem/shape/partition/sidecar activation
+// so it can be torn down if Pumba exits - normally, or via a trapped signal -
+// while they're still running. NetemContainer, NetemContainerFilter,
+// ShapeContainer and PartitionContainer register on success and their Stop*
+// counterparts unregister; RunSidecar registers a sidecar while it waits on it.
+type ChaosRegistry struct {
+	mu          sync.Mutex
+	activations map[string]activation
+}
+
+// NewChaosRegistry returns an empty registry.
+func NewChaosRegistry() *ChaosRegistry {
+	return &ChaosRegistry{activations: map[string]activation{}}
+}
+
+// Register records an active chaos activation under id, replacing any
+// previous activation registered under the same id. Safe for concurrent use.
+func (r *ChaosRegistry) Register(id string, kind ActivationKind, stop func() error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.activations[id] = activation{kind: kind, stop: stop}
+}
+
+// Unregister removes a previously registered activation, typically once it
+// has already been torn down through its own Stop* call. Safe for
+// concurrent use.
+func (r *ChaosRegistry) Unregister(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.activations, id)
+}
+
+// Cleanup runs every still-registered activation's stop closure in
+// parallel, bounded by ctx's deadline, and returns the first error
+// encountered (if any). The registry is drained up front, so a Cleanup call
+// never reverses the same activation twice even if it times out.
+func (r *ChaosRegistry) Cleanup(ctx context.Context) error {
+	r.mu.Lock()
+	pending := r.activations
+	r.activations = map[string]activation{}
+	r.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(pending))
+	for id, a := range pending {
+		wg.Add(1)
+		go func(id string, a activation) {
+			defer wg.Done()
+			errs <- stopActivation(id, a)
+		}(id, a)
+	}
+
+	// errs is only closed once every stop closure has actually sent its
+	// result, never on ctx timing out - a slow stop() (a hung
+	// ContainerRemove/iptables exec, say) must still find errs open when it
+	// eventually sends, or it panics with "send on closed channel".
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(errs)
+		close(done)
+	}()
+
+	var mu sync.Mutex
+	var firstErr error
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for err := range errs {
+			if err != nil {
+				log.Error(err)
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+		<-drained
+	case <-ctx.Done():
+		// leave the drain goroutine running in the background so it never
+		// blocks on a full errs channel; we just stop waiting on it here.
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return firstErr
+}
+
+// stopActivation runs a.stop(), recovering a panic into an error so that one
+// broken activation can't take down the rest of Cleanup.
+func stopActivation(id string, a activation) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic cleaning up %s activation %s: %v", a.kind, id, r)
+		}
+	}()
+	log.Debugf("cleaning up %s activation %s", a.kind, id)
+	return a.stop()
+}
+
+func netemActivationID(c Container, netInterface string) string {
+	return fmt.Sprintf("netem:%s:%s", c.ID(), netInterface)
+}
+
+func shapeActivationID(c Container, netInterface string) string {
+	return fmt.Sprintf("shape:%s:%s", c.ID(), netInterface)
+}
+
+func partitionActivationID(c Container, tag string) string {
+	return fmt.Sprintf("partition:%s:%s", c.ID(), tag)
+}
+
+func sidecarActivationID(c Container, sidecarID string) string {
+	return fmt.Sprintf("sidecar:%s:%s", c.ID(), sidecarID)
+}
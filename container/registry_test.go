@@ -0,0 +1,60 @@
+package container
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestChaosRegistryCleanupSurvivesPanic(t *testing.T) {
+	registry := NewChaosRegistry()
+
+	stopped := make(chan string, 2)
+	registry.Register("netem:c1:eth0", NetemActivation, func() error {
+		defer func() { stopped <- "netem:c1:eth0" }()
+		panic("boom")
+	})
+	registry.Register("shape:c2:eth0", ShapeActivation, func() error {
+		stopped <- "shape:c2:eth0"
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := registry.Cleanup(ctx); err == nil {
+		t.Fatal("expected Cleanup to surface the panicking activation as an error")
+	}
+	close(stopped)
+
+	got := map[string]bool{}
+	for id := range stopped {
+		got[id] = true
+	}
+	if !got["netem:c1:eth0"] || !got["shape:c2:eth0"] {
+		t.Fatalf("expected both activations to run despite the panic, got %v", got)
+	}
+
+	if n := len(registry.activations); n != 0 {
+		t.Fatalf("expected registry to be drained after Cleanup, got %d activations left", n)
+	}
+}
+
+func TestChaosRegistryUnregister(t *testing.T) {
+	registry := NewChaosRegistry()
+
+	called := false
+	registry.Register("netem:c1:eth0", NetemActivation, func() error {
+		called = true
+		return nil
+	})
+	registry.Unregister("netem:c1:eth0")
+
+	if err := registry.Cleanup(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if called {
+		t.Fatal("expected unregistered activation not to run on Cleanup")
+	}
+}
@@ -0,0 +1,156 @@
+package container
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// hugeRate is used for the htb classes that must never themselves become a
+// bottleneck (the parent class and the unthrottled default class).
+const hugeRate = "10000mbit"
+
+// ShapeSpec describes a bandwidth-shaping profile applied to a container's
+// network interface. Rate is the only mandatory field; Burst and Latency are
+// required by "tc qdisc ... tbf" and are ignored for htb. Ceil is only used
+// for the htb (filtered) case and defaults to Rate when empty.
+type ShapeSpec struct {
+	Rate    string // e.g. "1mbit"
+	Burst   string // e.g. "32kbit"
+	Latency string // e.g. "400ms"
+	Ceil    string // htb only; defaults to Rate
+}
+
+func (client dockerClient) ShapeContainer(c Container, netInterface string, spec ShapeSpec, targetIP net.IP, duration time.Duration, tcimage string, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	var err error
+	if targetIP == nil {
+		log.Infof("%sShaping container %s on '%s' to '%s' for %s", prefix, c.ID(), netInterface, spec.Rate, duration)
+		err = client.startShapeContainer(c, netInterface, spec, tcimage, dryrun)
+	} else {
+		log.Infof("%sShaping container %s on '%s' to '%s' with filter %s for %s", prefix, c.ID(), netInterface, spec.Rate, targetIP.String(), duration)
+		err = client.startShapeContainerIPFilter(c, netInterface, spec, targetIP.String(), tcimage, dryrun)
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if !dryrun && client.registry != nil {
+		client.registry.Register(shapeActivationID(c, netInterface), ShapeActivation, func() error {
+			return client.StopShapeContainer(c, netInterface, tcimage, false)
+		})
+	}
+	return nil
+}
+
+func (client dockerClient) StopShapeContainer(c Container, netInterface string, tcimage string, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	log.Infof("%sStopping shaping on container %s", prefix, c.ID())
+	err := client.stopShapeContainer(c, netInterface, tcimage, dryrun)
+	if err != nil {
+		log.Error(err)
+	}
+	if !dryrun && client.registry != nil {
+		client.registry.Unregister(shapeActivationID(c, netInterface))
+	}
+	return err
+}
+
+func (client dockerClient) startShapeContainer(c Container, netInterface string, spec ShapeSpec, tcimage string, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	log.Infof("%sStart shape for container %s on '%s' with rate '%s'", prefix, c.ID(), netInterface, spec.Rate)
+	if !dryrun {
+		// use ContainerExecCreate/Start to run Traffic Control:
+		// 'tc qdisc add dev eth0 root tbf rate 1mbit burst 32kbit latency 400ms'
+		// See more: http://man7.org/linux/man-pages/man8/tc-tbf.8.html
+		tbfCommand := []string{"qdisc", "add", "dev", netInterface, "root", "tbf",
+			"rate", spec.Rate, "burst", spec.Burst, "latency", spec.Latency}
+		log.Debugf("tbf command '%s'", strings.Join(tbfCommand, " "))
+		return client.tcCommand(c, tbfCommand, tcimage)
+	}
+	return nil
+}
+
+func (client dockerClient) stopShapeContainer(c Container, netInterface string, tcimage string, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	log.Infof("%sStop shaping for container %s on '%s'", prefix, c.ID(), netInterface)
+	if !dryrun {
+		// the root qdisc is removed the same way whether it was a plain tbf
+		// qdisc or the htb tree installed by startShapeContainerIPFilter
+		shapeCommand := []string{"qdisc", "del", "dev", netInterface, "root"}
+		log.Debugf("shape command '%s'", strings.Join(shapeCommand, " "))
+		return client.tcCommand(c, shapeCommand, tcimage)
+	}
+	return nil
+}
+
+func (client dockerClient) startShapeContainerIPFilter(c Container, netInterface string, spec ShapeSpec,
+	targetIP string, tcimage string, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	ceil := spec.Ceil
+	if ceil == "" {
+		ceil = spec.Rate
+	}
+	log.Infof("%sStart shape for container %s on '%s' with rate '%s', filter by IP '%s'",
+		prefix, c.ID(), netInterface, spec.Rate, targetIP)
+	if !dryrun {
+		// build an htb tree: the default class carries all traffic at full
+		// speed, the filtered class is capped to spec.Rate (bursting to Ceil)
+		// See more: http://lartc.org/howto/lartc.qdisc.classful.html
+
+		// 'tc qdisc add dev <netInterface> root handle 1: htb default 10'
+		handleCommand := []string{"qdisc", "add", "dev", netInterface, "root", "handle", "1:", "htb", "default", "10"}
+		log.Debugf("handleCommand %s", handleCommand)
+		if err := client.tcCommand(c, handleCommand, tcimage); err != nil {
+			return err
+		}
+
+		// 'tc class add dev <netInterface> parent 1: classid 1:1 htb rate <hugeRate>'
+		rootClassCommand := []string{"class", "add", "dev", netInterface, "parent", "1:", "classid", "1:1", "htb", "rate", hugeRate}
+		log.Debugf("rootClassCommand %s", rootClassCommand)
+		if err := client.tcCommand(c, rootClassCommand, tcimage); err != nil {
+			return err
+		}
+
+		// unthrottled default class
+		// 'tc class add dev <netInterface> parent 1:1 classid 1:10 htb rate <hugeRate>'
+		defaultClassCommand := []string{"class", "add", "dev", netInterface, "parent", "1:1", "classid", "1:10", "htb", "rate", hugeRate}
+		log.Debugf("defaultClassCommand %s", defaultClassCommand)
+		if err := client.tcCommand(c, defaultClassCommand, tcimage); err != nil {
+			return err
+		}
+
+		// shaped class that the filter below routes matching traffic into
+		// 'tc class add dev <netInterface> parent 1:1 classid 1:20 htb rate <rate> ceil <ceil>'
+		shapedClassCommand := []string{"class", "add", "dev", netInterface, "parent", "1:1", "classid", "1:20", "htb",
+			"rate", spec.Rate, "ceil", ceil}
+		log.Debugf("shapedClassCommand %s", shapedClassCommand)
+		if err := client.tcCommand(c, shapedClassCommand, tcimage); err != nil {
+			return err
+		}
+
+		// 'tc filter add dev <netInterface> protocol ip parent 1:0 prio 1 u32 match ip dst <targetIP> flowid 1:20'
+		filterCommand := []string{"filter", "add", "dev", netInterface, "protocol", "ip", "parent", "1:0", "prio", "1",
+			"u32", "match", "ip", "dst", targetIP, "flowid", "1:20"}
+		log.Debugf("filterCommand %s", filterCommand)
+		return client.tcCommand(c, filterCommand, tcimage)
+	}
+	return nil
+}
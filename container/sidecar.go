@@ -0,0 +1,219 @@
+package container
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/docker/api/types"
+	ctypes "github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+const defaultStressImage = "progrium/stress"
+
+// defaultSidecarTimeout bounds how long RunSidecar waits for a WaitForExit
+// sidecar that has no explicit Duration - i.e. a single quick command like
+// `tc` or `iptables` that is expected to return almost immediately.
+const defaultSidecarTimeout = 10 * time.Second
+
+// SidecarSpec describes a short-lived, privileged helper container launched
+// alongside a target container to carry out some disruptive action (tc,
+// iptables, stress, fsfreeze, ...). It generalizes what tcContainerCommand
+// used to do only for `tc`: share one or more of the target's namespaces,
+// auto-remove on exit, and never become a Pumba target itself.
+type SidecarSpec struct {
+	Image      string
+	Entrypoint []string
+	Cmd        []string
+	CapAdd     []string
+	// namespaces shared with the target container
+	ShareNetwork bool
+	SharePID     bool
+	ShareIPC     bool
+	// Mounts are passed through verbatim as Binds ("hostPath:containerPath[:ro]")
+	Mounts []string
+	// Duration, if set, makes RunSidecar block until the sidecar exits or
+	// Duration elapses, whichever comes first, and registers the sidecar in
+	// the ChaosRegistry for the wait so a trapped signal can still force-
+	// remove it. Use this for a long-running sidecar (stress, fsfreeze)
+	// whose own command manages the chaos's lifetime.
+	Duration time.Duration
+	// WaitForExit makes RunSidecar wait (bounded by defaultSidecarTimeout)
+	// for a quick, one-shot sidecar to exit and surfaces a non-zero exit
+	// code - or the wait timing out - as an error, instead of assuming
+	// success once the container starts. Ignored when Duration is set.
+	WaitForExit bool
+}
+
+// RunSidecar launches a sidecar container against target per spec and
+// returns its container ID. The sidecar always carries the
+// com.gaiaadm.pumba.skip label so Pumba never selects it as a target
+// itself, and always auto-removes on exit.
+func (client dockerClient) RunSidecar(target Container, spec SidecarSpec) (string, error) {
+	log.Debugf("sidecar image: %s", spec.Image)
+
+	config := ctypes.Config{
+		Labels:     map[string]string{"com.gaiaadm.pumba.skip": "true"},
+		Entrypoint: spec.Entrypoint,
+		Cmd:        spec.Cmd,
+		Image:      spec.Image,
+	}
+	log.Debugf("Container Config: %s", config)
+
+	hconfig := ctypes.HostConfig{
+		// auto remove container on exit
+		AutoRemove: true,
+		CapAdd:     spec.CapAdd,
+		Binds:      spec.Mounts,
+		// others
+		PortBindings: nat.PortMap{},
+		DNS:          []string{},
+		DNSOptions:   []string{},
+		DNSSearch:    []string{},
+	}
+	if spec.ShareNetwork {
+		hconfig.NetworkMode = ctypes.NetworkMode("container:" + target.ID())
+	}
+	if spec.SharePID {
+		hconfig.PidMode = ctypes.PidMode("container:" + target.ID())
+	}
+	if spec.ShareIPC {
+		hconfig.IpcMode = ctypes.IpcMode("container:" + target.ID())
+	}
+	log.Debugf("Host Config: %s", hconfig)
+
+	ctx := context.Background()
+	createResponse, err := client.apiClient.ContainerCreate(ctx, &config, &hconfig, nil, "")
+	if err != nil {
+		return "", err
+	}
+	id := createResponse.ID
+	log.Debugf("sidecar container id: %s", id)
+	if err := client.apiClient.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+		return id, err
+	}
+
+	switch {
+	case spec.Duration > 0:
+		return id, client.waitSidecar(target, id, spec.Duration, false)
+	case spec.WaitForExit:
+		return id, client.waitSidecar(target, id, defaultSidecarTimeout, true)
+	default:
+		return id, nil
+	}
+}
+
+// waitSidecar waits up to timeout for the sidecar container id to exit,
+// registering it in the ChaosRegistry for the duration of the wait so a
+// trapped signal can still force-remove it even if Pumba is killed while
+// waiting. checkExitCode treats a non-zero exit code, or the wait timing
+// out, as an error - appropriate for a quick one-shot command, but not for
+// a long-running stressor that is expected to still be running once its
+// Duration elapses.
+func (client dockerClient) waitSidecar(target Container, id string, timeout time.Duration, checkExitCode bool) error {
+	if client.registry != nil {
+		activationID := sidecarActivationID(target, id)
+		client.registry.Register(activationID, SidecarActivation, func() error {
+			return client.apiClient.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true})
+		})
+		defer client.registry.Unregister(activationID)
+	}
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	statusCh, errCh := client.apiClient.ContainerWait(waitCtx, id, "")
+	select {
+	case err := <-errCh:
+		return err
+	case status := <-statusCh:
+		if checkExitCode && status.StatusCode != 0 {
+			return fmt.Errorf("sidecar %s exited with code %d", id, status.StatusCode)
+		}
+		return nil
+	case <-waitCtx.Done():
+		if checkExitCode {
+			return fmt.Errorf("sidecar %s did not exit within %s", id, timeout)
+		}
+		return nil
+	}
+}
+
+// StressContainer runs a CPU/RAM stressor (progrium/stress, alexeiled/
+// stress-ng, ...) in a sidecar that shares the target's PID namespace. The
+// sidecar gets no cgroup setting of its own, so it is not placed under the
+// target's cgroup limits. args is passed straight through as the sidecar's command, e.g.
+// []string{"--cpu", "2", "--timeout", "60s"}.
+func (client dockerClient) StressContainer(c Container, args []string, stressImage string, duration time.Duration, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	if stressImage == "" {
+		stressImage = defaultStressImage
+	}
+	log.Infof("%sStressing container %s with '%s' for %s", prefix, c.ID(), args, duration)
+	if dryrun {
+		return nil
+	}
+	_, err := client.RunSidecar(c, SidecarSpec{
+		Image:    stressImage,
+		Cmd:      args,
+		SharePID: true,
+		Duration: duration,
+	})
+	return err
+}
+
+// IOStressContainer runs an IO stressor (fio, stress-ng --hdd, ...) in a
+// sidecar that shares the target's PID namespace. args is passed straight
+// through as the sidecar's command.
+func (client dockerClient) IOStressContainer(c Container, args []string, stressImage string, duration time.Duration, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	log.Infof("%sRunning IO stress on container %s with '%s' for %s", prefix, c.ID(), args, duration)
+	if dryrun {
+		return nil
+	}
+	_, err := client.RunSidecar(c, SidecarSpec{
+		Image:    stressImage,
+		Cmd:      args,
+		SharePID: true,
+		Duration: duration,
+	})
+	return err
+}
+
+// FreezeFilesystem freezes mountpoint on the target container for duration
+// using fsfreeze in a sidecar that bind-mounts the same path. The sidecar's
+// own command handles the freeze/sleep/unfreeze lifecycle, so it keeps
+// running and unfreezes on its own if Pumba exits early. RunSidecar also
+// registers it in the ChaosRegistry for the wait; a Cleanup during that wait
+// force-removes the sidecar, and its unfreeze step then does not run.
+func (client dockerClient) FreezeFilesystem(c Container, mountpoint string, duration time.Duration, freezeImage string, dryrun bool) error {
+	prefix := ""
+	if dryrun {
+		prefix = dryRunPrefix
+	}
+	log.Infof("%sFreezing filesystem %s on container %s for %s", prefix, mountpoint, c.ID(), duration)
+	if dryrun {
+		return nil
+	}
+	freezeCmd := fmt.Sprintf("fsfreeze --freeze %s && sleep %d && fsfreeze --unfreeze %s",
+		mountpoint, int(duration.Seconds()), mountpoint)
+	_, err := client.RunSidecar(c, SidecarSpec{
+		Image:      freezeImage,
+		Entrypoint: []string{"sh", "-c"},
+		Cmd:        []string{freezeCmd},
+		CapAdd:     []string{"SYS_ADMIN"},
+		SharePID:   true,
+		Mounts:     []string{mountpoint + ":" + mountpoint},
+		Duration:   duration,
+	})
+	return err
+}
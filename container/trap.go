@@ -0,0 +1,50 @@
+package container
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Trap sets up a handler for SIGINT and SIGTERM that runs cleanup and then
+// exits, modeled on Docker's classic signal.Trap helper: a buffered channel
+// so no signal is dropped while cleanup runs, and three repeated interrupts
+// force an immediate exit in case cleanup hangs. SIGQUIT is trapped (and
+// also triggers cleanup) by default, so a stray `kill -QUIT` still tears
+// down netem/tc/iptables state; it is only left untrapped, falling through
+// to the default handler's stack dump, when DEBUG is set.
+//
+// Callers (Pumba's main entrypoint) should call Trap once at startup,
+// passing a cleanup func that calls the active ChaosRegistry's Cleanup.
+func Trap(cleanup func()) {
+	c := make(chan os.Signal, 1)
+	signals := []os.Signal{os.Interrupt, syscall.SIGTERM}
+	if os.Getenv("DEBUG") == "" {
+		signals = append(signals, syscall.SIGQUIT)
+	}
+	signal.Notify(c, signals...)
+	go func() {
+		var interruptCount uint32
+		for sig := range c {
+			go func(sig os.Signal) {
+				log.Infof("Received signal '%v', starting shutdown...", sig)
+				switch sig {
+				case os.Interrupt, syscall.SIGTERM:
+					if atomic.AddUint32(&interruptCount, 1) < 3 {
+						cleanup()
+						os.Exit(0)
+					}
+					// 3 SIGINT/SIGTERM: force exit without waiting on cleanup
+					log.Info("Forcing exit without cleanup")
+					os.Exit(128)
+				default:
+					cleanup()
+					os.Exit(0)
+				}
+			}(sig)
+		}
+	}()
+}
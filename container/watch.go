@@ -0,0 +1,221 @@
+package container
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// startEventDebounce bounds how often a policy is re-applied to the same
+// container ID in response to the event stream, to absorb rapid start/stop
+// churn (e.g. a crash-looping container).
+const startEventDebounce = 2 * time.Second
+
+// ChaosKind identifies which chaos action a ChaosPolicy applies.
+type ChaosKind string
+
+const (
+	NetemChaos ChaosKind = "netem"
+	ShapeChaos ChaosKind = "shape"
+	KillChaos  ChaosKind = "kill"
+	PauseChaos ChaosKind = "pause"
+)
+
+// ChaosParams groups the per-kind parameters a ChaosPolicy needs; only the
+// fields relevant to Kind are read.
+type ChaosParams struct {
+	NetInterface string
+	NetemCmd     []string
+	Filter       TrafficFilter // netem only; any CIDR, port or Protocol set selects NetemContainerFilter over NetemContainer
+	TargetIP     net.IP        // netem/shape legacy single-IP filter
+	Shape        ShapeSpec
+	Signal       string // kill only; defaults to defaultKillSignal
+	TCImage      string
+	Duration     time.Duration
+}
+
+// ChaosPolicy declaratively describes a chaos action Watch applies
+// automatically whenever a container matching its Filter starts.
+type ChaosPolicy struct {
+	Kind   ChaosKind
+	Params ChaosParams
+	// Schedule re-applies the policy on a cadence for as long as the
+	// container keeps running. Only plain Go duration strings (e.g. "5m")
+	// are supported today; cron expressions are accepted by the type but
+	// not yet parsed, and fall back to a single, immediate application.
+	Schedule string
+	// Jitter randomizes each application by up to this much, so that a
+	// whole replica set isn't disrupted in lockstep.
+	Jitter time.Duration
+}
+
+// PolicyStore loads a set of ChaosPolicy values from wherever they are
+// configured (YAML/JSON file, etcd, ...). Concrete implementations live
+// outside this package, the same way Filter implementations do.
+type PolicyStore interface {
+	Policies() ([]ChaosPolicy, error)
+}
+
+// Watch subscribes to the Docker daemon's container event stream and, for
+// every "start" event whose container matches fn, applies policy. It blocks
+// until ctx is cancelled, reconnecting with exponential backoff on stream
+// errors, and returns ctx.Err() once cancelled.
+func (client dockerClient) Watch(ctx context.Context, fn Filter, policy ChaosPolicy) error {
+	eventFilter := filters.NewArgs()
+	eventFilter.Add("type", "container")
+	eventFilter.Add("event", "start")
+
+	backoff := time.Second
+	const maxBackoff = 30 * time.Second
+	lastApplied := map[string]time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		log.Debug("Watching Docker events for chaos policy application")
+		messages, errs := client.apiClient.Events(ctx, types.EventsOptions{Filters: eventFilter})
+
+		reconnect := false
+		for !reconnect {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case err, ok := <-errs:
+				if !ok {
+					reconnect = true
+					break
+				}
+				log.Errorf("chaos event stream error: %s; reconnecting in %s", err, backoff)
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				if backoff < maxBackoff {
+					backoff *= 2
+				}
+				reconnect = true
+			case msg, ok := <-messages:
+				if !ok {
+					reconnect = true
+					break
+				}
+				// a delivered event means the stream is healthy again
+				backoff = time.Second
+				client.handleStartEvent(msg, fn, policy, lastApplied)
+			}
+		}
+	}
+}
+
+func (client dockerClient) handleStartEvent(msg events.Message, fn Filter, policy ChaosPolicy, lastApplied map[string]time.Time) {
+	if last, ok := lastApplied[msg.ID]; ok && time.Since(last) < startEventDebounce {
+		log.Debugf("debouncing start event for container %s", msg.ID)
+		return
+	}
+
+	ctx := context.Background()
+	containerInfo, err := client.apiClient.ContainerInspect(ctx, msg.ID)
+	if err != nil {
+		log.Errorf("error inspecting started container %s: %s", msg.ID, err)
+		return
+	}
+	imageInfo, _, err := client.apiClient.ImageInspectWithRaw(ctx, containerInfo.Image)
+	if err != nil {
+		log.Errorf("error inspecting image for container %s: %s", msg.ID, err)
+		return
+	}
+	c := Container{containerInfo: containerInfo, imageInfo: imageInfo}
+	if !fn(c) {
+		return
+	}
+	lastApplied[msg.ID] = time.Now()
+
+	log.Infof("Container %s (%s) started, applying %s chaos policy", c.Name(), c.ID(), policy.Kind)
+	// applyPolicy may sleep for up to policy.Jitter; run it off the event
+	// loop so a jittered container doesn't delay reading the next event (or
+	// noticing ctx cancellation) and so concurrently-started containers are
+	// actually disrupted in parallel, not serialized by each other's jitter.
+	go func() {
+		if err := client.applyPolicy(c, policy); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	if policy.Schedule == "" {
+		return
+	}
+	interval, err := time.ParseDuration(policy.Schedule)
+	if err != nil {
+		log.Warnf("policy schedule %q is not a Go duration (cron schedules are not yet supported); applying once", policy.Schedule)
+		return
+	}
+	go client.schedulePolicy(c, policy, interval)
+}
+
+// schedulePolicy re-applies policy to c every interval for as long as c keeps running.
+func (client dockerClient) schedulePolicy(c Container, policy ChaosPolicy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := client.apiClient.ContainerInspect(context.Background(), c.ID())
+		if err != nil || !info.State.Running {
+			return
+		}
+		if err := client.applyPolicy(c, policy); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func (client dockerClient) applyPolicy(c Container, policy ChaosPolicy) error {
+	if jitter := jitterDuration(policy.Jitter); jitter > 0 {
+		time.Sleep(jitter)
+	}
+
+	p := policy.Params
+	switch policy.Kind {
+	case NetemChaos:
+		if hasTrafficFilter(p.Filter) {
+			return client.NetemContainerFilter(c, p.NetInterface, p.NetemCmd, p.Filter, p.Duration, p.TCImage, false)
+		}
+		return client.NetemContainer(c, p.NetInterface, p.NetemCmd, p.TargetIP, p.Duration, p.TCImage, false)
+	case ShapeChaos:
+		return client.ShapeContainer(c, p.NetInterface, p.Shape, p.TargetIP, p.Duration, p.TCImage, false)
+	case KillChaos:
+		signal := p.Signal
+		if signal == "" {
+			signal = defaultKillSignal
+		}
+		return client.KillContainer(c, signal, false)
+	case PauseChaos:
+		return client.PauseContainer(c, false)
+	default:
+		return fmt.Errorf("unknown chaos policy kind %q", policy.Kind)
+	}
+}
+
+func hasTrafficFilter(f TrafficFilter) bool {
+	return len(f.SrcCIDRs) > 0 || len(f.DstCIDRs) > 0 || len(f.SrcPorts) > 0 || len(f.DstPorts) > 0 ||
+		f.Protocol != ""
+}
+
+func jitterDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}